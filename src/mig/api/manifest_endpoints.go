@@ -15,11 +15,65 @@ import (
 	"io"
 	"io/ioutil"
 	"mig"
+	_ "mig/schema1"
 	"net/http"
 	"os"
 	"path"
+	"regexp"
 )
 
+// platformManifestFile describes one per-platform manifest.json found
+// while walking an operator's manifest tree.
+type platformManifestFile struct {
+	os, arch, variant string
+	path              string
+}
+
+// walkPlatformManifests finds every per-platform manifest.json under
+// proot, which is expected to be laid out as <arch>/<os>/manifest.json,
+// with an optional <arch>/<os>/<variant>/manifest.json alongside it for
+// platforms that need a variant-specific manifest.
+func walkPlatformManifests(proot string) ([]platformManifestFile, error) {
+	var ret []platformManifestFile
+	archEntries, err := ioutil.ReadDir(proot)
+	if err != nil {
+		return nil, err
+	}
+	for _, archEnt := range archEntries {
+		if !archEnt.IsDir() {
+			continue
+		}
+		archPath := path.Join(proot, archEnt.Name())
+		osEntries, err := ioutil.ReadDir(archPath)
+		if err != nil {
+			continue
+		}
+		for _, osEnt := range osEntries {
+			if !osEnt.IsDir() {
+				continue
+			}
+			osPath := path.Join(archPath, osEnt.Name())
+			if _, err := os.Stat(path.Join(osPath, "manifest.json")); err == nil {
+				ret = append(ret, platformManifestFile{osEnt.Name(), archEnt.Name(), "", path.Join(osPath, "manifest.json")})
+			}
+			variantEntries, err := ioutil.ReadDir(osPath)
+			if err != nil {
+				continue
+			}
+			for _, vEnt := range variantEntries {
+				if !vEnt.IsDir() {
+					continue
+				}
+				vpath := path.Join(osPath, vEnt.Name(), "manifest.json")
+				if _, err := os.Stat(vpath); err == nil {
+					ret = append(ret, platformManifestFile{osEnt.Name(), archEnt.Name(), vEnt.Name(), vpath})
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
 // API entry point used to request a file be sent to the loader from the API.
 func getManifestFile(respWriter http.ResponseWriter, request *http.Request) {
 	loc := fmt.Sprintf("%s%s", ctx.Server.Host, request.URL.String())
@@ -50,25 +104,25 @@ func getManifestFile(respWriter http.ResponseWriter, request *http.Request) {
 		panic(err)
 	}
 
-	root, manifest, err := manifestRoot(manifestParam)
+	_, manifest, err := manifestRoot(manifestParam)
 	if err != nil {
 		panic(err)
 	}
 
-	// Validate the object being requested exists in the manifest.
-	var mentry *mig.ManifestEntry
-	for i := range manifest.Entries {
-		if manifest.Entries[i].Name == manifestParam.Object {
-			mentry = &manifest.Entries[i]
+	// The loader requests objects by the digest of the blob it wants, as
+	// found among the manifest's referenced blobs, not by name.
+	var blob *mig.BlobDescriptor
+	for _, b := range manifest.References() {
+		if b.SHA256 == manifestParam.Object {
+			blob = &b
 			break
 		}
 	}
-	if mentry == nil {
+	if blob == nil {
 		panic("requested object does not exist in manifest")
 	}
 
-	filepath := path.Join(root, "files", mentry.Name)
-	buf, err := loadContent(filepath, mentry.SHA256)
+	buf, err := loadContent(blobPath(ctx.Manifest.Path, blob.SHA256), blob.SHA256)
 	if err != nil {
 		panic(err)
 	}
@@ -89,6 +143,65 @@ func getManifestFile(respWriter http.ResponseWriter, request *http.Request) {
 	respond(200, resource, respWriter, request)
 }
 
+var blobDigestPattern = regexp.MustCompile("^[a-f0-9]{64}$")
+
+// blobPath returns the on-disk path of a blob in the API's
+// content-addressable store, laid out the same way Docker/OCI registries
+// lay out blobs: blobs/sha256/<first two digest characters>/<full digest>.
+func blobPath(manifestRootPath, digest string) string {
+	return path.Join(manifestRootPath, "blobs", "sha256", digest[:2], digest)
+}
+
+// getBlob serves a blob directly from the content-addressable store by
+// digest. It's mounted at /blobs/sha256/{digest} and is the route new
+// manifest entries reference; getManifestFile above still exists for
+// loaders that request objects through the manifest-parameter flow.
+//
+// Unlike getManifestFile/loadContent, the blob is streamed straight from
+// disk rather than buffered and gzipped in memory, via http.ServeContent,
+// so that a loader resuming an interrupted download can issue a Range
+// request and get back exactly the bytes it's missing.
+func getBlob(respWriter http.ResponseWriter, request *http.Request) {
+	opid := getOpID(request)
+	defer func() {
+		if e := recover(); e != nil {
+			ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("%v", e)}.Err()
+			http.Error(respWriter, fmt.Sprintf("%v", e), 500)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: opid, Desc: "leaving getBlob()"}.Debug()
+	}()
+	digest := path.Base(request.URL.Path)
+	if !blobDigestPattern.MatchString(digest) {
+		panic("invalid blob digest")
+	}
+	fd, err := os.Open(blobPath(ctx.Manifest.Path, digest))
+	if err != nil {
+		panic(err)
+	}
+	defer fd.Close()
+
+	// Verify the on-disk file's digest matches its path before streaming
+	// it, the same guarantee loadContent gives getManifestFile, so a
+	// corrupted or mislabeled blob is never served as if it were trusted.
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		panic(err)
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != digest {
+		panic("blob content does not match its digest")
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		panic(err)
+	}
+	respWriter.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(respWriter, request, digest, fi.ModTime(), fd)
+}
+
 // Load the file from the file system, we also compress it and return a byte
 // slice. Validate the SHA256 sum of the file against the sum that was
 // specified in the manifest to ensure we are sending the correct data.
@@ -136,6 +249,13 @@ func loadContent(path string, sig string) ([]byte, error) {
 // indicates the most current version of the agent to be used. The loader
 // sends some basic information in the request parameters so the API can decide
 // which manifest to send the loader.
+//
+// Two shapes of request are handled here. If the request carries no
+// digest, the loader is asking for the manifest list: the full set of
+// per-platform manifests available for its operator, so it can pick the
+// one matching its own platform. If the request carries a digest, the
+// loader has already picked a descriptor from that list and is asking
+// for the concrete manifest it references.
 func getAgentManifest(respWriter http.ResponseWriter, request *http.Request) {
 	loc := fmt.Sprintf("%s%s", ctx.Server.Host, request.URL.String())
 	opid := getOpID(request)
@@ -158,13 +278,40 @@ func getAgentManifest(respWriter http.ResponseWriter, request *http.Request) {
 	if err != nil {
 		panic(err)
 	}
+
+	if manifestParam.Digest != "" {
+		err = manifestParam.ValidateDigest()
+		if err != nil {
+			panic(err)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("Received manifest request for digest %v", manifestParam.Digest)}.Debug()
+
+		m, err := manifestByDigest(manifestParam)
+		if err != nil {
+			panic(err)
+		}
+		err = resource.AddItem(cljs.Item{
+			Href: request.URL.String(),
+			Data: []cljs.Data{
+				{
+					Name:  "manifest",
+					Value: m,
+				},
+			}})
+		if err != nil {
+			panic(err)
+		}
+		respond(200, resource, respWriter, request)
+		return
+	}
+
 	err = manifestParam.Validate()
 	if err != nil {
 		panic(err)
 	}
-	ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("Received manifest request")}.Debug()
+	ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("Received manifest list request")}.Debug()
 
-	_, m, err := manifestRoot(manifestParam)
+	ml, err := manifestListRoot(manifestParam)
 	if err != nil {
 		panic(err)
 	}
@@ -172,8 +319,8 @@ func getAgentManifest(respWriter http.ResponseWriter, request *http.Request) {
 		Href: request.URL.String(),
 		Data: []cljs.Data{
 			{
-				Name:  "manifest",
-				Value: m,
+				Name:  "manifestlist",
+				Value: ml,
 			},
 		}})
 	if err != nil {
@@ -182,25 +329,72 @@ func getAgentManifest(respWriter http.ResponseWriter, request *http.Request) {
 	respond(200, resource, respWriter, request)
 }
 
-func manifestLoad(path string) (mig.ManifestResponse, error) {
-	ret := mig.ManifestResponse{}
+func manifestLoad(path string) (mig.Manifest, error) {
 	fd, err := os.Open(path)
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
 	defer fd.Close()
 	buf, err := ioutil.ReadAll(fd)
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
-	err = json.Unmarshal(buf, &ret)
-	if err != nil {
-		return ret, err
+	return mig.DecodeManifest(buf)
+}
+
+// manifestListRoot builds the manifest list for an operator, falling
+// back to the "default" operator tree if the operator has none of its
+// own, mirroring the fallback manifestRoot() performs for a single
+// manifest.
+func manifestListRoot(p mig.ManifestParameters) (mig.ManifestList, error) {
+	for _, proot := range []string{path.Join(ctx.Manifest.Path, p.Operator), path.Join(ctx.Manifest.Path, "default")} {
+		files, err := walkPlatformManifests(proot)
+		if err != nil || len(files) == 0 {
+			continue
+		}
+		ml := mig.ManifestList{}
+		for _, f := range files {
+			buf, err := ioutil.ReadFile(f.path)
+			if err != nil {
+				continue
+			}
+			ml.Manifests = append(ml.Manifests, mig.ManifestDescriptor{
+				Platform: mig.ManifestPlatform{OS: f.os, Arch: f.arch, Variant: f.variant},
+				Digest:   fmt.Sprintf("%x", sha256.Sum256(buf)),
+				Size:     int64(len(buf)),
+			})
+		}
+		if len(ml.Manifests) > 0 {
+			return ml, nil
+		}
 	}
-	return ret, nil
+	return mig.ManifestList{}, fmt.Errorf("manifestListRoot() -> no manifests found for operator %v", p.Operator)
+}
+
+// manifestByDigest locates the per-platform manifest referenced by
+// p.Digest in the operator's manifest tree (falling back to "default")
+// and loads it.
+func manifestByDigest(p mig.ManifestParameters) (mig.Manifest, error) {
+	for _, proot := range []string{path.Join(ctx.Manifest.Path, p.Operator), path.Join(ctx.Manifest.Path, "default")} {
+		files, err := walkPlatformManifests(proot)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			buf, err := ioutil.ReadFile(f.path)
+			if err != nil {
+				continue
+			}
+			if fmt.Sprintf("%x", sha256.Sum256(buf)) != p.Digest {
+				continue
+			}
+			return mig.DecodeManifest(buf)
+		}
+	}
+	return nil, fmt.Errorf("manifestByDigest() -> no manifest found for digest %v", p.Digest)
 }
 
-func manifestRoot(p mig.ManifestParameters) (string, mig.ManifestResponse, error) {
+func manifestRoot(p mig.ManifestParameters) (string, mig.Manifest, error) {
 	// Construct the path to the manifest using the parameters supplied by
 	// the client. These should be validated to be safe via
 	// ManifestParameters.Validate().
@@ -216,5 +410,5 @@ func manifestRoot(p mig.ManifestParameters) (string, mig.ManifestResponse, error
 	if err == nil {
 		return psecondary, m, nil
 	}
-	return "", mig.ManifestResponse{}, fmt.Errorf("unable to locate manifest")
+	return "", nil, fmt.Errorf("unable to locate manifest")
 }
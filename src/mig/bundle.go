@@ -9,20 +9,27 @@ package mig
 // manifests and state bundles by the MIG loader and API.
 
 import (
+	"bufio"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"regexp"
 	"runtime"
+	"strings"
+	"time"
 )
 
 // Manifest parameters are sent from the loader to the API as part of
 // a manifest request.
 type ManifestParameters struct {
-	Operator string `json:"operator"` // Agent operator
-	OS       string `json:"os"`       // Operating system
-	Arch     string `json:"arch"`     // Architecture
+	Operator string `json:"operator"`         // Agent operator
+	OS       string `json:"os"`               // Operating system
+	Arch     string `json:"arch"`             // Architecture
+	Digest   string `json:"digest,omitempty"` // Request the per-platform manifest with this digest, instead of the manifest list
 }
 
 func (m *ManifestParameters) Validate() error {
@@ -40,13 +47,141 @@ func (m *ManifestParameters) Validate() error {
 	return nil
 }
 
-type ManifestResponse struct {
-	Entries []ManifestEntry `json:"entries"`
+// ValidateDigest is used in place of Validate() when the request is for a
+// specific per-platform manifest referenced from a manifest list, rather
+// than the list itself.
+func (m *ManifestParameters) ValidateDigest() error {
+	if m.Operator == "" || m.Digest == "" {
+		return fmt.Errorf("invalid manifest parameters")
+	}
+	pre := regexp.MustCompile("^[A-Za-z0-9]+$")
+	if !pre.MatchString(m.Operator) {
+		return fmt.Errorf("bad characters in manifest parameters")
+	}
+	digpre := regexp.MustCompile("^[a-f0-9]{64}$")
+	if !digpre.MatchString(m.Digest) {
+		return fmt.Errorf("bad digest in manifest parameters")
+	}
+	return nil
+}
+
+// BlobDescriptor references a blob in the API's content-addressable blob
+// store by digest, the way an OCI/Docker image manifest references a
+// layer. The same blob can be referenced by any number of manifest
+// entries across operators and platforms, since it's addressed by the
+// content's own hash rather than a name.
+type BlobDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// KeyringEntry is a single approved operator key. Keys with a non-zero
+// Expires in the past are treated as untrusted by a schema's Verify().
+type KeyringEntry struct {
+	PublicKey ed25519.PublicKey
+	Expires   time.Time
+}
+
+// Keyring is the trust store used to verify manifest signatures, indexed
+// by key ID.
+type Keyring map[string]KeyringEntry
+
+// LoadKeyring reads a keyring from a JSON file on disk. The file format is
+// a map of key ID to an object carrying the base64-encoded ed25519 public
+// key and an optional RFC3339 expiry timestamp.
+func LoadKeyring(p string) (Keyring, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var raw map[string]struct {
+		PublicKey string `json:"publickey"`
+		Expires   string `json:"expires"`
+	}
+	if err := json.NewDecoder(fd).Decode(&raw); err != nil {
+		return nil, err
+	}
+	ret := make(Keyring)
+	for keyID, v := range raw {
+		pubbuf, err := base64.StdEncoding.DecodeString(v.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("LoadKeyring() -> key %v: %v", keyID, err)
+		}
+		if len(pubbuf) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("LoadKeyring() -> key %v: invalid public key length", keyID)
+		}
+		kentry := KeyringEntry{PublicKey: ed25519.PublicKey(pubbuf)}
+		if v.Expires != "" {
+			kentry.Expires, err = time.Parse(time.RFC3339, v.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("LoadKeyring() -> key %v: %v", keyID, err)
+			}
+		}
+		ret[keyID] = kentry
+	}
+	return ret, nil
 }
 
-type ManifestEntry struct {
-	Name   string `json:"name"`   // Corresponds to a bundle name
-	SHA256 string `json:"sha256"` // SHA256 of entry
+// ManifestList is a top-level index document served at /manifest: it
+// enumerates the concrete per-platform manifests the API has available
+// for an operator, analogous to an OCI/Docker manifest list. The loader
+// picks the descriptor matching its own platform, then requests that
+// manifest by digest.
+type ManifestList struct {
+	Manifests []ManifestDescriptor `json:"manifests"`
+}
+
+// ManifestDescriptor references one per-platform manifest by digest, the
+// way it would be stored content-addressably under the API's manifest
+// root.
+type ManifestDescriptor struct {
+	Platform ManifestPlatform `json:"platform"`
+	Digest   string           `json:"digest"` // sha256 of the referenced manifest document
+	Size     int64            `json:"size"`
+}
+
+// ManifestPlatform identifies the host platform a manifest applies to.
+// Variant distinguishes hosts that share an OS and architecture but need
+// a different manifest, for example a Linux distribution family or a
+// Windows Server release.
+type ManifestPlatform struct {
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Variant string `json:"variant,omitempty"`
+}
+
+// DetectVariant attempts to identify a more specific platform variant
+// than GOOS/GOARCH alone, for example distinguishing a Debian from an
+// RHEL based Linux host. An empty return value means no variant could be
+// determined, which callers should treat as "no variant" rather than an
+// error.
+func DetectVariant() string {
+	switch runtime.GOOS {
+	case "linux":
+		return detectLinuxVariant()
+	}
+	return ""
+}
+
+// detectLinuxVariant reads the distribution ID out of /etc/os-release
+// (e.g. "debian", "rhel", "alpine"), which is the closest thing to a
+// standard across modern distributions.
+func detectLinuxVariant() string {
+	fd, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "ID="), "\"")
+		}
+	}
+	return ""
 }
 
 // The bundle dictionary is used to map tokens within the loader manifest to
@@ -60,21 +195,47 @@ type BundleDictionaryEntry struct {
 	SHA256 string
 }
 
+// BundleDictionaryKey selects a set of bundle entries for a given OS, and
+// optionally a more specific variant of that OS (see DetectVariant). A
+// key with an empty Variant acts as the default for that OS.
+type BundleDictionaryKey struct {
+	OS      string
+	Variant string
+}
+
 var bundleEntryLinux = []BundleDictionaryEntry{
 	{"agent", "/sbin/mig-agent", ""},
 	{"configuration", "/etc/mig/mig-agent.cfg", ""},
 }
 
-var BundleDictionary = map[string][]BundleDictionaryEntry{
-	"linux": bundleEntryLinux,
+var bundleEntryWindows = []BundleDictionaryEntry{
+	{"agent", `C:\Program Files\mig\mig-agent.exe`, ""},
+	{"configuration", `C:\Program Files\mig\mig-agent.cfg`, ""},
 }
 
-func GetHostBundle() ([]BundleDictionaryEntry, error) {
-	switch runtime.GOOS {
-	case "linux":
-		return bundleEntryLinux, nil
+var bundleEntryDarwin = []BundleDictionaryEntry{
+	{"agent", "/usr/local/sbin/mig-agent", ""},
+	{"configuration", "/etc/mig/mig-agent.cfg", ""},
+}
+
+var BundleDictionary = map[BundleDictionaryKey][]BundleDictionaryEntry{
+	{OS: "linux"}:   bundleEntryLinux,
+	{OS: "windows"}: bundleEntryWindows,
+	{OS: "darwin"}:  bundleEntryDarwin,
+}
+
+// GetHostBundle returns the bundle entries for the current host. variant
+// should be the value returned by DetectVariant(); if no entry exists for
+// that specific variant, the OS's default entry (no variant) is used
+// instead.
+func GetHostBundle(variant string) ([]BundleDictionaryEntry, error) {
+	if b, ok := BundleDictionary[BundleDictionaryKey{OS: runtime.GOOS, Variant: variant}]; ok {
+		return b, nil
+	}
+	if b, ok := BundleDictionary[BundleDictionaryKey{OS: runtime.GOOS}]; ok {
+		return b, nil
 	}
-	return nil, fmt.Errorf("GetHostBundle() -> no entry for %v in bundle dictionary", runtime.GOOS)
+	return nil, fmt.Errorf("GetHostBundle() -> no entry for %v (variant %q) in bundle dictionary", runtime.GOOS, variant)
 }
 
 func HashBundle(b []BundleDictionaryEntry) ([]BundleDictionaryEntry, error) {
@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Vlad Diaconescu vlad@mig.example
+
+// cas-migrate walks an existing loader manifest root laid out as
+// <operator>/<arch>/<os>/{manifest.json,files/*} and migrates it to the
+// content-addressable blob store layout used by the API: each file under
+// files/ that a manifest entry names is copied to
+// blobs/sha256/<first two digest characters>/<digest>,
+// and the manifest's entries are rewritten to reference blobs by
+// descriptor instead of by file name.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mig"
+	"mig/schema1"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// digestFile returns the sha256 digest and size of the file at p.
+func digestFile(p string) (string, int64, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, fd)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+// migrateBlob copies the file at src into the CAS layout rooted at
+// blobsRoot, keyed by its own digest, and returns a descriptor for it. If
+// the blob is already present (shared with an earlier manifest) the copy
+// is skipped.
+func migrateBlob(blobsRoot, src string) (mig.BlobDescriptor, error) {
+	digest, size, err := digestFile(src)
+	if err != nil {
+		return mig.BlobDescriptor{}, err
+	}
+	desc := mig.BlobDescriptor{MediaType: "application/octet-stream", Size: size, SHA256: digest}
+	dst := path.Join(blobsRoot, digest[:2], digest)
+	if _, err := os.Stat(dst); err == nil {
+		return desc, nil
+	}
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return mig.BlobDescriptor{}, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return mig.BlobDescriptor{}, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return mig.BlobDescriptor{}, err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return mig.BlobDescriptor{}, err
+	}
+	return desc, nil
+}
+
+// migrateManifest rewrites one manifest.json in place, replacing its
+// entries' file-name references with blob descriptors, and populates
+// blobsRoot with the files those descriptors reference.
+func migrateManifest(manifestPath, filesDir, blobsRoot string) error {
+	buf, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var m schema1.Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return err
+	}
+	if m.MediaType == "" {
+		// manifest.json predates the Versioned envelope; stamp it so the
+		// API and loader can still decode it through the schema registry
+		// once it's written back out.
+		m.SchemaVersion = 1
+		m.MediaType = schema1.MediaType
+	}
+	for i := range m.Entries {
+		src := path.Join(filesDir, m.Entries[i].Name)
+		desc, err := migrateBlob(blobsRoot, src)
+		if err != nil {
+			return fmt.Errorf("migrateManifest() -> %v: %v", src, err)
+		}
+		m.Entries[i].Blob = desc
+		fmt.Fprintf(os.Stderr, "cas-migrate: %v -> %v\n", src, desc.SHA256)
+	}
+	out, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, out, 0644)
+}
+
+func main() {
+	root := flag.String("root", "", "manifest root to migrate (contains <operator>/<arch>/<os>/manifest.json)")
+	flag.Parse()
+	if *root == "" {
+		fmt.Fprintf(os.Stderr, "cas-migrate: -root is required\n")
+		os.Exit(1)
+	}
+
+	blobsRoot := path.Join(*root, "blobs", "sha256")
+	err := filepath.Walk(*root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "manifest.json" {
+			return nil
+		}
+		filesDir := path.Join(path.Dir(p), "files")
+		if _, err := os.Stat(filesDir); os.IsNotExist(err) {
+			// Already migrated, or never had a files/ directory.
+			return nil
+		}
+		return migrateManifest(p, filesDir, blobsRoot)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cas-migrate: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -12,26 +12,77 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"crypto/sha256"
+	"encoding"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/jvehent/cljs"
 	"io"
 	"io/ioutil"
 	"mig"
+	"mig/schema1"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"runtime"
 	"strings"
 )
 
-var apiManifest *mig.ManifestResponse
+// apiManifest is decoded through the schema registry, so its concrete
+// type depends on the MediaType the API served. Code that needs
+// schema1-specific behavior (signature verification, name-keyed entries)
+// type-asserts it to *schema1.Manifest.
+var apiManifest mig.Manifest
+
+// expectedPlatform is the descriptor requestManifest selected from the
+// manifest list, i.e. what we actually asked the API for by digest.
+// verifyManifest checks apiManifest's own signed Operator/Platform
+// against this, so a manifest that carries a valid signature but was
+// issued for a different operator or platform is still rejected.
+var expectedPlatform mig.ManifestPlatform
+
+// keyringPath is set from the -keyring flag, and points at the keyring of
+// approved operator keys used to verify the manifest served by the API.
+// The loader refuses to act on a manifest unless it can be verified
+// against this keyring.
+var keyringPath string
+
+// verifyManifest checks apiManifest against the keyring at keyringPath,
+// logging the key IDs that validated the signature. A valid signature
+// alone isn't enough: the manifest list is served unsigned, so a
+// compromised or MITM'd API could hand us the digest of a different,
+// still-validly-signed manifest. verifyManifest also confirms the
+// manifest's own signed Operator/Platform match what we asked for,
+// closing that gap. It returns an error if the manifest can't be
+// trusted.
+func verifyManifest() error {
+	if keyringPath == "" {
+		return fmt.Errorf("verifyManifest() -> no -keyring specified, refusing to trust manifest")
+	}
+	sm, ok := apiManifest.(*schema1.Manifest)
+	if !ok {
+		return fmt.Errorf("verifyManifest() -> don't know how to verify a %T manifest", apiManifest)
+	}
+	keyring, err := mig.LoadKeyring(keyringPath)
+	if err != nil {
+		return err
+	}
+	keyIDs, err := sm.Verify(keyring)
+	if err != nil {
+		return err
+	}
+	if sm.Operator != manifestOperator() || sm.Platform != expectedPlatform {
+		return fmt.Errorf("verifyManifest() -> manifest signed for operator %q platform %+v, wanted operator %q platform %+v",
+			sm.Operator, sm.Platform, manifestOperator(), expectedPlatform)
+	}
+	fmt.Fprintf(os.Stderr, "verifyManifest() -> manifest signed by %v\n", keyIDs)
+	return nil
+}
 
 func initializeHaveBundle() ([]mig.BundleDictionaryEntry, error) {
-	ret, err := mig.GetHostBundle()
+	ret, err := mig.GetHostBundle(mig.DetectVariant())
 	if err != nil {
 		return nil, err
 	}
@@ -46,82 +97,98 @@ func initializeHaveBundle() ([]mig.BundleDictionaryEntry, error) {
 	return ret, nil
 }
 
-func requestManifest() error {
-	murl := APIURL + "manifest"
-	fmt.Fprintf(os.Stderr, "requestManifest() -> requesting manifest from %v\n", murl)
-
-	mparam := mig.ManifestParameters{}
-	mparam.OS = runtime.GOOS
-	mparam.Arch = runtime.GOARCH
+// manifestOperator returns the operator tag to send with manifest
+// requests, defaulting to "default" when the loader has no operator tag
+// configured.
+func manifestOperator() string {
 	if TAGS.Operator == "" {
-		mparam.Operator = "default"
-	} else {
-		mparam.Operator = TAGS.Operator
-	}
-	buf, err := json.Marshal(mparam)
-	if err != nil {
-		return err
+		return "default"
 	}
-	mstring := string(buf)
-	data := url.Values{"parameters": {mstring}}
-	r, err := http.NewRequest("POST", murl, strings.NewReader(data.Encode()))
+	return TAGS.Operator
+}
+
+// requestManifest retrieves the manifest list for this host's operator,
+// picks the descriptor matching the local platform, and fetches that
+// specific manifest by digest.
+func requestManifest() error {
+	list, err := requestManifestList()
 	if err != nil {
 		return err
 	}
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	client := http.Client{}
-	resp, err := client.Do(r)
+	variant := mig.DetectVariant()
+	desc, err := selectManifestDescriptor(list, variant)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	fmt.Fprintf(os.Stderr, "requestManifest() -> selected manifest %v for %v/%v variant %q\n",
+		desc.Digest, desc.Platform.OS, desc.Platform.Arch, desc.Platform.Variant)
+	manifest, err := requestManifestByDigest(desc.Digest)
 	if err != nil {
 		return err
 	}
+	apiManifest = manifest
+	expectedPlatform = desc.Platform
+	return nil
+}
 
-	var resource *cljs.Resource
-	err = json.Unmarshal(body, &resource)
-	if err != nil {
-		return err
+// selectManifestDescriptor picks the descriptor from list matching the
+// running platform. A descriptor matching both platform and variant is
+// preferred; failing that, the platform's variant-less default is used.
+func selectManifestDescriptor(list mig.ManifestList, variant string) (mig.ManifestDescriptor, error) {
+	var fallback *mig.ManifestDescriptor
+	for i := range list.Manifests {
+		d := &list.Manifests[i]
+		if d.Platform.OS != runtime.GOOS || d.Platform.Arch != runtime.GOARCH {
+			continue
+		}
+		if variant != "" && d.Platform.Variant == variant {
+			return *d, nil
+		}
+		if d.Platform.Variant == "" {
+			fallback = d
+		}
 	}
-
-	// Extract our manifest from the response.
-	manifest, err := valueToManifest(resource.Collection.Items[0].Data[0].Value)
-	if err != nil {
-		return err
+	if fallback != nil {
+		return *fallback, nil
 	}
-	apiManifest = &manifest
-
-	return nil
+	return mig.ManifestDescriptor{}, fmt.Errorf("selectManifestDescriptor() -> no manifest for %v/%v variant %q", runtime.GOOS, runtime.GOARCH, variant)
 }
 
-func valueToManifest(v interface{}) (m mig.ManifestResponse, err error) {
-	b, err := json.Marshal(v)
+// requestManifestList requests the manifest list from the API.
+func requestManifestList() (mig.ManifestList, error) {
+	murl := APIURL + "manifest"
+	fmt.Fprintf(os.Stderr, "requestManifestList() -> requesting manifest list from %v\n", murl)
+
+	mparam := mig.ManifestParameters{}
+	mparam.OS = runtime.GOOS
+	mparam.Arch = runtime.GOARCH
+	mparam.Operator = manifestOperator()
+	resource, err := postManifestRequest(murl, mparam)
 	if err != nil {
-		return
+		return mig.ManifestList{}, err
 	}
-	err = json.Unmarshal(b, &m)
-	return
+	return valueToManifestList(resource.Collection.Items[0].Data[0].Value)
 }
 
-func valueToFetchResponse(v interface{}) (m mig.ManifestFetchResponse, err error) {
-	b, err := json.Marshal(v)
+// requestManifestByDigest requests the concrete per-platform manifest
+// referenced by digest in a previously fetched manifest list.
+func requestManifestByDigest(digest string) (mig.Manifest, error) {
+	murl := APIURL + "manifest"
+	fmt.Fprintf(os.Stderr, "requestManifestByDigest() -> requesting manifest %v from %v\n", digest, murl)
+
+	mparam := mig.ManifestParameters{}
+	mparam.Operator = manifestOperator()
+	mparam.Digest = digest
+	resource, err := postManifestRequest(murl, mparam)
 	if err != nil {
-		return
+		return nil, err
 	}
-	err = json.Unmarshal(b, &m)
-	return
+	return valueToManifest(resource.Collection.Items[0].Data[0].Value)
 }
 
-func fetchFile(n string) ([]byte, error) {
-	murl := APIURL + "manifest/fetch"
-
-	mparam := mig.ManifestParameters{}
-	mparam.OS = runtime.GOOS
-	mparam.Arch = runtime.GOARCH
-	mparam.Operator = TAGS.Operator
-	mparam.Object = n
+// postManifestRequest POSTs mparam to murl and returns the decoded cljs
+// resource, the common first step shared by all loader/API requests.
+func postManifestRequest(murl string, mparam mig.ManifestParameters) (*cljs.Resource, error) {
 	buf, err := json.Marshal(mparam)
 	if err != nil {
 		return nil, err
@@ -149,126 +216,499 @@ func fetchFile(n string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return resource, nil
+}
 
-	// Extract fetch response.
-	fetchresp, err := valueToFetchResponse(resource.Collection.Items[0].Data[0].Value)
+// valueToManifest decodes v, a cljs item's raw JSON value, through the
+// manifest schema registry, so the returned Manifest's concrete type
+// depends on the MediaType the API served.
+func valueToManifest(v interface{}) (mig.Manifest, error) {
+	b, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
+	return mig.DecodeManifest(b)
+}
 
-	// Decompress the returned file and return it as a byte slice.
-	b := bytes.NewBuffer(fetchresp.Data)
-	gz, err := gzip.NewReader(b)
+func valueToManifestList(v interface{}) (m mig.ManifestList, err error) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		return nil, err
+		return
 	}
-	ret, err := ioutil.ReadAll(gz)
+	err = json.Unmarshal(b, &m)
+	return
+}
+
+// blobState is the on-disk resumption record for an in-progress blob
+// download: the number of bytes already written to the staging file, and
+// a checkpoint of the running SHA256 over those bytes, so a retry can
+// pick up where it left off instead of re-hashing from byte zero.
+type blobState struct {
+	Offset int64  `json:"offset"`
+	Hash   []byte `json:"hash"` // hash.Hash state, via encoding.BinaryMarshaler
+}
+
+// blobStatePath returns the sibling state file a staged download's
+// progress is checkpointed to.
+func blobStatePath(stagePath string) string {
+	return stagePath + ".state"
+}
+
+func readBlobState(stagePath string) (*blobState, error) {
+	buf, err := ioutil.ReadFile(blobStatePath(stagePath))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
+	var s blobState
+	if err := json.Unmarshal(buf, &s); err != nil {
+		// A corrupt state file (e.g. from a kill mid-write, before
+		// writeBlobState wrote atomically) isn't recoverable; treat it
+		// the same as no state at all and let fetchBlob restart the
+		// download from scratch instead of failing permanently.
+		fmt.Fprintf(os.Stderr, "readBlobState() -> %v is corrupt (%v), restarting download from scratch\n", blobStatePath(stagePath), err)
+		return nil, nil
+	}
+	return &s, nil
+}
 
-	return ret, nil
+func writeBlobState(stagePath string, s blobState) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(blobStatePath(stagePath), buf, 0600)
+}
+
+func removeBlobState(stagePath string) error {
+	err := os.Remove(blobStatePath(stagePath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
-func fetchAndReplace(entry mig.BundleDictionaryEntry, sig string) error {
-	// Grab the new file from the API.
-	filebuf, err := fetchFile(entry.Name)
+// fetchBlob downloads the blob identified by digest from the API's
+// content-addressable store, streaming it into stagePath rather than
+// buffering it in memory. If stagePath has a .state file left over from
+// an interrupted download, the transfer resumes from its recorded offset
+// via a Range request; the running SHA256 is checkpointed to that same
+// state file after every read, so resuming doesn't require re-hashing
+// bytes already on disk. If the server doesn't honor the Range request
+// and returns a full 200 response, the download restarts from scratch.
+func fetchBlob(digest, stagePath string) error {
+	h := sha256.New()
+	var offset int64
+	openFlags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+
+	state, err := readBlobState(stagePath)
 	if err != nil {
 		return err
 	}
+	if state != nil {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Hash); err != nil {
+			return err
+		}
+		offset = state.Offset
+		openFlags = os.O_WRONLY | os.O_APPEND
+	}
 
-	// Stage the new file. Write the file recieved from the API to the
-	// file system and validate the signature of the new file to make
-	// sure it matches the signature from the manifest.
-	//
-	// Append .loader to the file name to use as the staged file path.
-	reppath := entry.Path + ".loader"
-	fd, err := os.OpenFile(reppath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0700)
+	murl := APIURL + "blobs/sha256/" + digest
+	r, err := http.NewRequest("GET", murl, nil)
 	if err != nil {
 		return err
 	}
-	_, err = fd.Write(filebuf)
+	if offset > 0 {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	client := http.Client{}
+	resp, err := client.Do(r)
 	if err != nil {
 		return err
 	}
-	fd.Close()
+	defer resp.Body.Close()
 
-	// Validate the signature on the new file.
-	h := sha256.New()
-	fd, err = os.Open(reppath)
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusOK:
+		fmt.Fprintf(os.Stderr, "fetchBlob() -> server ignored Range request for %v, restarting from scratch\n", digest)
+		h = sha256.New()
+		offset = 0
+		openFlags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if err := removeBlobState(stagePath); err != nil {
+			return err
+		}
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent:
+		return fmt.Errorf("fetchBlob() -> unexpected status %v fetching %v", resp.Status, digest)
+	}
+
+	fd, err := os.OpenFile(stagePath, openFlags, 0700)
 	if err != nil {
 		return err
 	}
-	buf := make([]byte, 4096)
-	for {
-		n, err := fd.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fd.Close()
+	defer fd.Close()
+	if offset > 0 {
+		// Drop any bytes written after the last checkpoint, so appending
+		// resumes exactly at the recorded offset.
+		if err := fd.Truncate(offset); err != nil {
 			return err
 		}
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
 		if n > 0 {
+			if _, err := fd.Write(buf[:n]); err != nil {
+				return err
+			}
 			h.Write(buf[:n])
+			offset += int64(n)
+			hstate, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := writeBlobState(stagePath, blobState{Offset: offset, Hash: hstate}); err != nil {
+				return err
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				break
+			}
+			return rerr
 		}
 	}
-	fd.Close()
-	if sig != fmt.Sprintf("%x", h.Sum(nil)) {
-		return fmt.Errorf("staged file signature mismatch")
+
+	got := fmt.Sprintf("%x", h.Sum(nil))
+	if got != digest {
+		// Discard the checkpoint along with the bad data: a digest
+		// mismatch means what's on disk can't be trusted, so a retry
+		// must restart from scratch rather than resume from an offset
+		// that matches a file we now know is wrong.
+		removeBlobState(stagePath)
+		return fmt.Errorf("fetchBlob() -> staged file signature mismatch for %v, got %v", stagePath, got)
+	}
+	return removeBlobState(stagePath)
+}
+
+// writeFileAtomic writes buf to path by writing it to a temp file
+// alongside path first and renaming it into place, so a crash mid-write
+// can never leave a truncated or partially-written file at path. It's
+// the same pattern copyFile uses for the .prev snapshot.
+func writeFileAtomic(path string, buf []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// journalPath is where the loader records the progress of an
+// in-progress transactional update, so a crash partway through can be
+// detected and rolled back on the next invocation. It's a var rather
+// than a const so tests can point it at a temp directory.
+var journalPath = "/var/lib/mig/loader.journal"
+
+// loaderJournal is the on-disk record of a transactional update in
+// progress. It's written before phase two (commit) begins and removed
+// once the transaction finishes, successfully or not.
+type loaderJournal struct {
+	Entries []journalEntry `json:"entries"`
+}
+
+// journalEntry tracks one file's progress through phase two: the target
+// path, the digest it's being updated to, and whether the rename has
+// completed.
+type journalEntry struct {
+	Path      string `json:"path"`
+	Digest    string `json:"digest"`
+	Committed bool   `json:"committed"`
+}
+
+func writeJournal(j loaderJournal) error {
+	if err := os.MkdirAll(path.Dir(journalPath), 0755); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(j)
+	if err != nil {
+		return err
 	}
+	return writeFileAtomic(journalPath, buf, 0600)
+}
 
-	// Got this far, OK to proceed with the replacement.
-	err = os.Rename(reppath, entry.Path)
+func readJournal() (*loaderJournal, error) {
+	buf, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var j loaderJournal
+	if err := json.Unmarshal(buf, &j); err != nil {
+		// A corrupt journal can't tell us what to roll back, but
+		// leaving it in place would fail the same way on every future
+		// run and brick the host. Treat it as nothing to recover;
+		// worst case we leave a stray .prev snapshot behind instead of
+		// permanently refusing to start.
+		fmt.Fprintf(os.Stderr, "readJournal() -> %v is corrupt (%v), treating as no journal\n", journalPath, err)
+		return nil, nil
+	}
+	return &j, nil
+}
 
+func removeJournal() error {
+	err := os.Remove(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
-func checkEntry(entry mig.BundleDictionaryEntry) error {
-	var compare mig.ManifestEntry
-	fmt.Fprintf(os.Stderr, "checkEntry() -> Comparing %v %v\n", entry.Name, entry.Path)
-	found := false
-	for _, x := range apiManifest.Entries {
-		if x.Name == entry.Name {
-			compare = x
-			found = true
+// recoverJournal looks for a journal left behind by a loader run that
+// crashed partway through phase two, and finishes it one way or the
+// other: if every entry's rename had already completed, the transaction
+// is kept and only the .prev snapshots are cleaned up; otherwise every
+// entry is rolled back from its .prev snapshot. This runs before we do
+// anything else so a host is never left running with a mix of old and
+// new files.
+func recoverJournal() error {
+	j, err := readJournal()
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "recoverJournal() -> found a journal from a previous run, recovering\n")
+	complete := true
+	for _, e := range j.Entries {
+		if digest, err := fileSHA256(e.Path); err != nil || digest != e.Digest {
+			complete = false
 			break
 		}
 	}
-	if !found {
-		fmt.Fprintf(os.Stderr, "checkEntry() -> entry not in manifest, ignoring\n")
-		return nil
+	for _, e := range j.Entries {
+		prevPath := e.Path + ".prev"
+		if complete {
+			// Every rename completed before the crash; nothing to roll
+			// back, just clean up the snapshot.
+			os.Remove(prevPath)
+			continue
+		}
+		if _, err := os.Stat(prevPath); err != nil {
+			// No snapshot: either this entry's rename never started, or
+			// the file didn't exist before the transaction.
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "recoverJournal() -> restoring %v from %v\n", e.Path, prevPath)
+		if err := os.Rename(prevPath, e.Path); err != nil {
+			return err
+		}
 	}
-	fmt.Fprintf(os.Stderr, "checkEntry() -> We have %v\n", entry.SHA256)
-	fmt.Fprintf(os.Stderr, "checkEntry() -> API has %v\n", compare.SHA256)
-	if entry.SHA256 == compare.SHA256 {
-		fmt.Fprintf(os.Stderr, "checkEntry() -> Nothing to do here...\n")
-		//return nil
+	return removeJournal()
+}
+
+// fileSHA256 returns the sha256 digest of the file at p.
+func fileSHA256(p string) (string, error) {
+	fd, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// copyFile copies src to dst, preserving src's permissions. It's used to
+// snapshot a live file before it's replaced, so a failed transaction can
+// restore it. The copy is written to a temp file next to dst and only
+// renamed into place once it's complete, so a loader killed mid-copy can
+// never leave a truncated dst for recoverJournal to mistake for a good
+// snapshot.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
-	fmt.Fprintf(os.Stderr, "checkEntry() -> refreshing %v\n", entry.Name)
-	err := fetchAndReplace(entry, compare.SHA256)
+	defer in.Close()
+	info, err := in.Stat()
 	if err != nil {
 		return err
 	}
-	return nil
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// pendingUpdate pairs a bundle entry with the API's descriptor for it,
+// once we've determined the two differ.
+type pendingUpdate struct {
+	entry mig.BundleDictionaryEntry
+	blob  mig.BlobDescriptor
+}
+
+// planUpdates compares have against the API manifest and returns the
+// entries whose digest differs, without touching the file system.
+// Matching entries by name is a schema1-specific notion, so this
+// type-asserts apiManifest rather than going through the generic
+// mig.Manifest interface.
+func planUpdates(have []mig.BundleDictionaryEntry) ([]pendingUpdate, error) {
+	sm, ok := apiManifest.(*schema1.Manifest)
+	if !ok {
+		return nil, fmt.Errorf("planUpdates() -> don't know how to plan updates from a %T manifest", apiManifest)
+	}
+	var ret []pendingUpdate
+	for _, entry := range have {
+		var compare schema1.ManifestEntry
+		found := false
+		for _, x := range sm.Entries {
+			if x.Name == entry.Name {
+				compare = x
+				found = true
+				break
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "planUpdates() -> %v not in manifest, ignoring\n", entry.Name)
+			continue
+		}
+		if entry.SHA256 == compare.Blob.SHA256 {
+			// The digest already matches what we have on disk, so
+			// there's nothing to download; this also covers the case
+			// where the same blob is shared across operators or
+			// platforms.
+			fmt.Fprintf(os.Stderr, "planUpdates() -> %v digest already matches, nothing to do\n", entry.Name)
+			continue
+		}
+		ret = append(ret, pendingUpdate{entry: entry, blob: compare.Blob})
+	}
+	return ret, nil
+}
+
+// stageUpdate fetches the blob for an update into its <path>.loader
+// staging file, without touching the live file. fetchBlob resumes the
+// transfer from any progress left behind by a previous, interrupted
+// attempt, and verifies the staged file's digest itself.
+func stageUpdate(u pendingUpdate) error {
+	reppath := u.entry.Path + ".loader"
+	return fetchBlob(u.blob.SHA256, reppath)
+}
+
+// commitUpdate snapshots the live file to <path>.prev (if it exists),
+// then renames the already-staged file over it.
+func commitUpdate(u pendingUpdate) error {
+	if _, err := os.Stat(u.entry.Path); err == nil {
+		if err := copyFile(u.entry.Path, u.entry.Path+".prev"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(u.entry.Path+".loader", u.entry.Path)
+}
+
+// rollbackUpdate restores a committed entry from its .prev snapshot.
+func rollbackUpdate(u pendingUpdate) error {
+	prevPath := u.entry.Path + ".prev"
+	if _, err := os.Stat(prevPath); err != nil {
+		return nil
+	}
+	return os.Rename(prevPath, u.entry.Path)
+}
+
+// commitUpdates runs phase two of the transaction: the files for updates
+// have already been staged by stageUpdate, and this commits them one at
+// a time, snapshotting each target first. A journal is written before
+// the first commit and updated after each one, so recoverJournal can
+// finish the job if this process is killed partway through. If a commit
+// fails partway through, every entry committed so far is rolled back
+// from its snapshot, in reverse order.
+func commitUpdates(updates []pendingUpdate) error {
+	j := loaderJournal{}
+	for _, u := range updates {
+		j.Entries = append(j.Entries, journalEntry{Path: u.entry.Path, Digest: u.blob.SHA256})
+	}
+	if err := writeJournal(j); err != nil {
+		return err
+	}
+
+	var committed []pendingUpdate
+	for i, u := range updates {
+		fmt.Fprintf(os.Stderr, "commitUpdates() -> committing %v\n", u.entry.Name)
+		if err := commitUpdate(u); err != nil {
+			fmt.Fprintf(os.Stderr, "commitUpdates() -> commit of %v failed (%v), rolling back\n", u.entry.Name, err)
+			for k := len(committed) - 1; k >= 0; k-- {
+				if rerr := rollbackUpdate(committed[k]); rerr != nil {
+					fmt.Fprintf(os.Stderr, "commitUpdates() -> rollback of %v failed: %v\n", committed[k].entry.Name, rerr)
+				}
+			}
+			removeJournal()
+			return err
+		}
+		committed = append(committed, u)
+		j.Entries[i].Committed = true
+		if err := writeJournal(j); err != nil {
+			return err
+		}
+	}
+
+	return removeJournal()
 }
 
 // Compare the manifest that the API sent with our knowledge of what is
-// currently installed. For each case there is a difference, we will
-// request the new file and replace the existing entry.
+// currently installed, and apply any differences as a single
+// transaction. Phase one fetches and verifies every changed file into a
+// staging path without touching anything live. Phase two, commitUpdates,
+// then commits the staged files one at a time.
 func compareManifest(have []mig.BundleDictionaryEntry) error {
-	for _, x := range have {
-		err := checkEntry(x)
-		if err != nil {
+	updates, err := planUpdates(have)
+	if err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	for _, u := range updates {
+		fmt.Fprintf(os.Stderr, "compareManifest() -> staging %v\n", u.entry.Name)
+		if err := stageUpdate(u); err != nil {
 			return err
 		}
 	}
-	return nil
+
+	return commitUpdates(updates)
 }
 
 func main() {
+	flag.StringVar(&keyringPath, "keyring", "", "path to keyring of approved operator keys")
+	flag.Parse()
 	runtime.GOMAXPROCS(1)
 
+	// Finish any transaction left in progress by a previous run before
+	// doing anything else.
+	err := recoverJournal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main() -> %v\n", err)
+		os.Exit(1)
+	}
+
 	// Get our current status from the file system.
 	have, err := initializeHaveBundle()
 	if err != nil {
@@ -283,6 +723,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The manifest must carry a valid signature from an approved operator
+	// key before we ever act on it.
+	err = verifyManifest()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main() -> %v\n", err)
+		os.Exit(1)
+	}
+
 	err = compareManifest(have)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "main() -> %v\n", err)
@@ -0,0 +1,359 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Vlad Diaconescu vlad@mig.example
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mig"
+	"mig/schema1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestKeyring writes a single-key keyring file in the format
+// mig.LoadKeyring expects, and returns its path.
+func writeTestKeyring(t *testing.T, keyID string, pub ed25519.PublicKey) string {
+	t.Helper()
+	raw := map[string]struct {
+		PublicKey string `json:"publickey"`
+	}{
+		keyID: {PublicKey: base64.StdEncoding.EncodeToString(pub)},
+	}
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "keyring.json")
+	if err := ioutil.WriteFile(p, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestVerifyManifestRejectsPlatformMismatch covers the gap chunk0-2 left
+// open: a manifest can carry a perfectly valid signature from an
+// approved key while still having been issued for a different
+// operator/platform than the one we asked for (e.g. a compromised API
+// handing back the digest of some other manifest it also happens to
+// have signed). verifyManifest must reject that, not just check that
+// *some* signature validates.
+func TestVerifyManifestRejectsPlatformMismatch(t *testing.T) {
+	origKeyringPath, origAPIManifest, origExpected, origTagsOperator := keyringPath, apiManifest, expectedPlatform, TAGS.Operator
+	defer func() {
+		keyringPath, apiManifest, expectedPlatform, TAGS.Operator = origKeyringPath, origAPIManifest, origExpected, origTagsOperator
+	}()
+	TAGS.Operator = "op1"
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyringPath = writeTestKeyring(t, "key1", pub)
+
+	m := schema1.New()
+	m.Operator = "op1"
+	m.Platform = mig.ManifestPlatform{OS: "linux", Arch: "amd64"}
+	if err := m.SignManifest("key1", priv); err != nil {
+		t.Fatal(err)
+	}
+	apiManifest = m
+
+	expectedPlatform = m.Platform
+	if err := verifyManifest(); err != nil {
+		t.Fatalf("expected a manifest matching the requested operator/platform to verify, got %v", err)
+	}
+
+	expectedPlatform = mig.ManifestPlatform{OS: "linux", Arch: "arm64"}
+	if err := verifyManifest(); err == nil {
+		t.Fatal("expected a manifest signed for a different platform than requested to fail verification")
+	}
+
+	expectedPlatform = m.Platform
+	TAGS.Operator = "op2"
+	if err := verifyManifest(); err == nil {
+		t.Fatal("expected a manifest signed for a different operator than requested to fail verification")
+	}
+}
+
+// withJournalPath points journalPath at a file inside a fresh temp
+// directory for the duration of a test, so tests never touch the real
+// /var/lib/mig/loader.journal.
+func withJournalPath(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	orig := journalPath
+	journalPath = filepath.Join(dir, "loader.journal")
+	t.Cleanup(func() { journalPath = orig })
+	return dir
+}
+
+// stageEntry writes content to path+".loader", the staging location
+// commitUpdate expects, and returns a pendingUpdate referencing it.
+func stageEntry(t *testing.T, name, path, content string) pendingUpdate {
+	t.Helper()
+	if err := ioutil.WriteFile(path+".loader", []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return pendingUpdate{
+		entry: mig.BundleDictionaryEntry{Name: name, Path: path},
+		blob:  mig.BlobDescriptor{SHA256: name + "-digest"},
+	}
+}
+
+func TestCommitUpdatesAppliesAllEntries(t *testing.T) {
+	withJournalPath(t)
+	dir := t.TempDir()
+
+	agentPath := filepath.Join(dir, "agent")
+	confPath := filepath.Join(dir, "conf")
+	if err := ioutil.WriteFile(agentPath, []byte("old-agent"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(confPath, []byte("old-conf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	updates := []pendingUpdate{
+		stageEntry(t, "agent", agentPath, "new-agent"),
+		stageEntry(t, "conf", confPath, "new-conf"),
+	}
+
+	if err := commitUpdates(updates); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct{ path, content string }{
+		{agentPath, "new-agent"},
+		{confPath, "new-conf"},
+	} {
+		got, err := ioutil.ReadFile(want.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want.content {
+			t.Fatalf("%v: got %q, want %q", want.path, got, want.content)
+		}
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Fatalf("expected journal to be removed after a clean commit, stat err = %v", err)
+	}
+}
+
+// TestCommitUpdatesRollsBackOnPartialFailure simulates a commit failing
+// partway through a multi-file update (standing in for a disk-full or
+// similar I/O failure on one file): the second entry has no staged
+// ".loader" file, so its os.Rename in commitUpdate fails. The first
+// entry, already committed, must be rolled back from its .prev snapshot,
+// and the journal must be cleaned up rather than left behind.
+func TestCommitUpdatesRollsBackOnPartialFailure(t *testing.T) {
+	withJournalPath(t)
+	dir := t.TempDir()
+
+	agentPath := filepath.Join(dir, "agent")
+	confPath := filepath.Join(dir, "conf")
+	if err := ioutil.WriteFile(agentPath, []byte("old-agent"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(confPath, []byte("old-conf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	updates := []pendingUpdate{
+		stageEntry(t, "agent", agentPath, "new-agent"),
+		// conf is deliberately left unstaged, so committing it fails.
+		{entry: mig.BundleDictionaryEntry{Name: "conf", Path: confPath}, blob: mig.BlobDescriptor{SHA256: "conf-digest"}},
+	}
+
+	if err := commitUpdates(updates); err == nil {
+		t.Fatal("expected commitUpdates to fail when an entry has no staged file")
+	}
+
+	got, err := ioutil.ReadFile(agentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "old-agent" {
+		t.Fatalf("expected the committed entry to be rolled back, got %q", got)
+	}
+	if _, err := os.Stat(agentPath + ".prev"); !os.IsNotExist(err) {
+		t.Fatalf("expected .prev snapshot to be consumed by rollback, stat err = %v", err)
+	}
+	got, err = ioutil.ReadFile(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "old-conf" {
+		t.Fatalf("expected the entry whose commit failed to be untouched, got %q", got)
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Fatalf("expected journal to be removed after a failed commit, stat err = %v", err)
+	}
+}
+
+func TestReadJournalTreatsCorruptJournalAsNone(t *testing.T) {
+	withJournalPath(t)
+	if err := ioutil.WriteFile(journalPath, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := readJournal()
+	if err != nil {
+		t.Fatalf("expected a corrupt journal to be treated as no journal, got error %v", err)
+	}
+	if j != nil {
+		t.Fatalf("expected a nil journal, got %+v", j)
+	}
+}
+
+func TestRecoverJournalNoopWithoutJournal(t *testing.T) {
+	withJournalPath(t)
+	if err := recoverJournal(); err != nil {
+		t.Fatalf("expected no journal to be a no-op, got %v", err)
+	}
+}
+
+// TestRecoverJournalRestoresUncommittedEntry simulates a crash between
+// the .prev snapshot rename and the live-file rename: the journal lists
+// the entry, a .prev snapshot exists, but the live file still holds the
+// old content (its digest won't match the journal's). recoverJournal
+// must restore it from the snapshot.
+func TestRecoverJournalRestoresUncommittedEntry(t *testing.T) {
+	withJournalPath(t)
+	dir := t.TempDir()
+	livePath := filepath.Join(dir, "agent")
+
+	if err := ioutil.WriteFile(livePath, []byte("old-agent"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(livePath+".prev", []byte("old-agent"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	j := loaderJournal{Entries: []journalEntry{{Path: livePath, Digest: "new-agent-digest"}}}
+	if err := writeJournal(j); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recoverJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(livePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "old-agent" {
+		t.Fatalf("got %q, want %q", got, "old-agent")
+	}
+	if _, err := os.Stat(livePath + ".prev"); !os.IsNotExist(err) {
+		t.Fatalf("expected .prev snapshot to be consumed, stat err = %v", err)
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Fatalf("expected journal to be removed, stat err = %v", err)
+	}
+}
+
+// TestRecoverJournalCleansUpCommittedEntry simulates a crash after the
+// live-file rename completed but before the journal was removed: the
+// live file's digest now matches the journal entry, so recoverJournal
+// must leave it alone and just discard the now-stale .prev snapshot.
+func TestRecoverJournalCleansUpCommittedEntry(t *testing.T) {
+	withJournalPath(t)
+	dir := t.TempDir()
+	livePath := filepath.Join(dir, "agent")
+
+	if err := ioutil.WriteFile(livePath, []byte("new-agent"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(livePath+".prev", []byte("old-agent"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileSHA256(livePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := loaderJournal{Entries: []journalEntry{{Path: livePath, Digest: digest}}}
+	if err := writeJournal(j); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recoverJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(livePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new-agent" {
+		t.Fatalf("got %q, want %q", got, "new-agent")
+	}
+	if _, err := os.Stat(livePath + ".prev"); !os.IsNotExist(err) {
+		t.Fatalf("expected stale .prev snapshot to be cleaned up, stat err = %v", err)
+	}
+}
+
+func TestCopyFilePreservesContentAndMode(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("got content %q, want %q", got, "hello")
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+	if _, err := os.Stat(dst + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected temp file to be cleaned up, stat err = %v", err)
+	}
+}
+
+// TestCopyFileLeavesDestUntouchedOnCopyFailure exercises the scenario the
+// .prev snapshot's atomic-rename exists for: a copy that fails partway
+// through (here, a directory where copyFile expects a readable file,
+// standing in for a loader killed mid-copy) must never leave dst
+// truncated or otherwise modified, since recoverJournal trusts dst's
+// .prev snapshot unconditionally once it's present.
+func TestCopyFileLeavesDestUntouchedOnCopyFailure(t *testing.T) {
+	dir := t.TempDir()
+	srcDir := filepath.Join(dir, "not-a-file")
+	if err := os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(dst, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyFile(srcDir, dst); err == nil {
+		t.Fatal("expected copyFile to fail when src is a directory")
+	}
+
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "original" {
+		t.Fatalf("dst was modified by a failed copy: got %q, want %q", got, "original")
+	}
+	if _, err := os.Stat(dst + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected temp file to be cleaned up, stat err = %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Vlad Diaconescu vlad@mig.example
+package mig
+
+// This file contains the manifest schema registry: a small plugin point
+// that lets the API and loader decode manifests by the MediaType they
+// declare instead of statically assuming a single format. Concrete
+// schemas, such as the schema1 package, register themselves here from an
+// init() function.
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Versioned is embedded at the top of every manifest document. It lets a
+// reader identify the schema of a manifest before decoding the rest of
+// the payload.
+type Versioned struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+}
+
+// Manifest is implemented by every manifest schema. The API's response
+// dispatch and the loader's decoding select an unmarshaller by MediaType
+// and hand back a Manifest, so neither has to branch on format.
+type Manifest interface {
+	// Payload returns the manifest's media type and the canonical,
+	// signable representation of its content.
+	Payload() (mediaType string, payload []byte, err error)
+	// References returns the blobs this manifest refers to.
+	References() []BlobDescriptor
+}
+
+// ManifestUnmarshalFunc decodes a manifest document of a specific media
+// type.
+type ManifestUnmarshalFunc func([]byte) (Manifest, error)
+
+var manifestSchemas = make(map[string]ManifestUnmarshalFunc)
+
+// RegisterManifestSchema registers the unmarshaller for a manifest media
+// type. Schema packages call this from an init() function, so importing
+// a schema package is enough to make it available to DecodeManifest.
+func RegisterManifestSchema(mediaType string, unmarshal ManifestUnmarshalFunc) {
+	manifestSchemas[mediaType] = unmarshal
+}
+
+// DecodeManifest reads the MediaType out of buf's Versioned envelope and
+// dispatches to the unmarshaller registered for it.
+func DecodeManifest(buf []byte) (Manifest, error) {
+	var v Versioned
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, err
+	}
+	unmarshal, ok := manifestSchemas[v.MediaType]
+	if !ok {
+		return nil, fmt.Errorf("DecodeManifest() -> no schema registered for media type %q", v.MediaType)
+	}
+	return unmarshal(buf)
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Vlad Diaconescu vlad@mig.example
+
+// mig-loader-manifest signs a schema1 manifest.json in place with an
+// operator's ed25519 private key, the counterpart to the public keyring
+// mig.LoadKeyring loads for the loader's verification. It's the missing
+// half of signed manifests: without it, nothing ever populates a real
+// manifest.json's Signatures field, so the loader's verifyManifest can
+// never succeed against one.
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mig/schema1"
+	"os"
+	"strings"
+)
+
+func main() {
+	manifestPath := flag.String("manifest", "", "path to the manifest.json to sign, in place")
+	keyPath := flag.String("key", "", "path to a file holding the base64-encoded ed25519 private key")
+	keyID := flag.String("keyid", "", "key ID to embed in the signature, matching an entry in the loader's keyring")
+	flag.Parse()
+	if *manifestPath == "" || *keyPath == "" || *keyID == "" {
+		fmt.Fprintf(os.Stderr, "mig-loader-manifest: -manifest, -key and -keyid are all required\n")
+		os.Exit(1)
+	}
+
+	priv, err := loadPrivateKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mig-loader-manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := signManifestFile(*manifestPath, *keyID, priv); err != nil {
+		fmt.Fprintf(os.Stderr, "mig-loader-manifest: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "mig-loader-manifest: signed %v with key %v\n", *manifestPath, *keyID)
+}
+
+// loadPrivateKey reads a base64-encoded ed25519 private key from p.
+func loadPrivateKey(p string) (ed25519.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	privbuf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("loadPrivateKey() -> %v", err)
+	}
+	if len(privbuf) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("loadPrivateKey() -> invalid private key length")
+	}
+	return ed25519.PrivateKey(privbuf), nil
+}
+
+// signManifestFile reads the manifest at manifestPath, adds a signature
+// over it under keyID, and writes it back in place. A manifest that
+// predates the Versioned envelope is stamped with schema1's media type
+// first, mirroring cas-migrate's handling of the same case.
+func signManifestFile(manifestPath, keyID string, priv ed25519.PrivateKey) error {
+	buf, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var m schema1.Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return err
+	}
+	if m.MediaType == "" {
+		m.SchemaVersion = 1
+		m.MediaType = schema1.MediaType
+	}
+	if err := m.SignManifest(keyID, priv); err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, out, 0644)
+}
@@ -0,0 +1,168 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Vlad Diaconescu vlad@mig.example
+
+// Package schema1 is the original MIG loader manifest format: a flat list
+// of named entries, each a content-addressed blob reference, with an
+// optional set of detached signatures over the list. It implements
+// mig.Manifest and registers itself with mig.RegisterManifestSchema so
+// the API and loader can decode it without knowing its format up front.
+package schema1
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mig"
+	"sort"
+	"time"
+)
+
+// MediaType identifies this schema in a manifest's Versioned envelope.
+const MediaType = "application/vnd.mig.manifest.schema1+json"
+
+func init() {
+	mig.RegisterManifestSchema(MediaType, func(buf []byte) (mig.Manifest, error) {
+		var m Manifest
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	})
+}
+
+// Manifest is the schema1 manifest document.
+type Manifest struct {
+	mig.Versioned
+	Operator   string               `json:"operator"` // Operator this manifest was issued for
+	Platform   mig.ManifestPlatform `json:"platform"`  // Host platform this manifest was issued for
+	Entries    []ManifestEntry      `json:"entries"`
+	Signatures []ManifestSignature  `json:"signatures,omitempty"` // Detached signatures over Operator, Platform and Entries
+}
+
+// New returns an empty schema1 manifest with its Versioned envelope set.
+func New() *Manifest {
+	return &Manifest{Versioned: mig.Versioned{SchemaVersion: 1, MediaType: MediaType}}
+}
+
+type ManifestEntry struct {
+	Name string             `json:"name"` // Corresponds to a bundle name
+	Blob mig.BlobDescriptor `json:"blob"` // Content-addressed reference to the entry's data
+}
+
+// ManifestSignature is one detached, JWS-style signature over a
+// manifest's canonicalised payload (its operator, platform and entries,
+// see signedPayload). A manifest can carry more
+// than one of these, for example while rotating between two approved
+// operator keys.
+type ManifestSignature struct {
+	Header    string `json:"header"`    // Base64-encoded JSON, identifies the signing key
+	Signature string `json:"signature"` // Base64-encoded signature over the canonical payload
+}
+
+// sigHeader is the decoded form of ManifestSignature.Header.
+type sigHeader struct {
+	KeyID string `json:"keyid"`
+}
+
+// signedPayload is the subset of a Manifest that's actually signed/verified:
+// the operator and platform it was issued for, plus its entries sorted
+// by name so field ordering and the Signatures slice itself don't affect
+// what's signed. Binding Operator and Platform into the signed content
+// is what stops a validly-signed manifest for one operator/platform from
+// being substituted for another's by a compromised or MITM'd API.
+type signedPayload struct {
+	Operator string               `json:"operator"`
+	Platform mig.ManifestPlatform `json:"platform"`
+	Entries  []ManifestEntry      `json:"entries"`
+}
+
+// Payload implements mig.Manifest.
+func (m *Manifest) Payload() (string, []byte, error) {
+	entries := make([]ManifestEntry, len(m.Entries))
+	copy(entries, m.Entries)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	buf, err := json.Marshal(signedPayload{Operator: m.Operator, Platform: m.Platform, Entries: entries})
+	return MediaType, buf, err
+}
+
+// References implements mig.Manifest.
+func (m *Manifest) References() []mig.BlobDescriptor {
+	ret := make([]mig.BlobDescriptor, len(m.Entries))
+	for i := range m.Entries {
+		ret[i] = m.Entries[i].Blob
+	}
+	return ret
+}
+
+// Verify checks the manifest's detached signatures against keyring. At
+// least one signature must validate against a non-expired key for the
+// manifest to be considered trusted. It returns the key IDs whose
+// signature validated, for logging, or an error if no signature
+// validated. Verify only establishes that the manifest is one an
+// approved key actually signed; it does not know what operator/platform
+// the caller wanted, so callers that fetched this manifest for a
+// specific operator/platform must separately check m.Operator and
+// m.Platform against what they asked for.
+func (m *Manifest) Verify(keyring mig.Keyring) ([]string, error) {
+	if len(m.Signatures) == 0 {
+		return nil, fmt.Errorf("Manifest.Verify() -> manifest carries no signatures")
+	}
+	_, payload, err := m.Payload()
+	if err != nil {
+		return nil, err
+	}
+	var verified []string
+	for _, sig := range m.Signatures {
+		hdrbuf, err := base64.StdEncoding.DecodeString(sig.Header)
+		if err != nil {
+			continue
+		}
+		var hdr sigHeader
+		if err := json.Unmarshal(hdrbuf, &hdr); err != nil {
+			continue
+		}
+		kentry, ok := keyring[hdr.KeyID]
+		if !ok {
+			continue
+		}
+		if !kentry.Expires.IsZero() && kentry.Expires.Before(time.Now()) {
+			continue
+		}
+		sigbuf, err := base64.StdEncoding.DecodeString(sig.Signature)
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(kentry.PublicKey, payload, sigbuf) {
+			verified = append(verified, hdr.KeyID)
+		}
+	}
+	if len(verified) == 0 {
+		return nil, fmt.Errorf("Manifest.Verify() -> no valid signature from an approved key")
+	}
+	return verified, nil
+}
+
+// SignManifest adds a detached signature over the manifest's canonical
+// payload, produced with priv and identified by keyID. The
+// mig-loader-manifest tooling uses it to sign a manifest before it is
+// published; the API serves manifests as stored and does not sign them.
+func (m *Manifest) SignManifest(keyID string, priv ed25519.PrivateKey) error {
+	_, payload, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	hdrbuf, err := json.Marshal(sigHeader{KeyID: keyID})
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(priv, payload)
+	m.Signatures = append(m.Signatures, ManifestSignature{
+		Header:    base64.StdEncoding.EncodeToString(hdrbuf),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	})
+	return nil
+}
@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Vlad Diaconescu vlad@mig.example
+package schema1
+
+import (
+	"crypto/ed25519"
+	"mig"
+	"testing"
+	"time"
+)
+
+func testManifest() *Manifest {
+	m := New()
+	m.Operator = "op1"
+	m.Platform = mig.ManifestPlatform{OS: "linux", Arch: "amd64"}
+	m.Entries = []ManifestEntry{
+		{Name: "agent", Blob: mig.BlobDescriptor{MediaType: "application/octet-stream", Size: 4, SHA256: "deadbeef"}},
+	}
+	return m
+}
+
+func TestVerifyAcceptsValidSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := m.SignManifest("op1", priv); err != nil {
+		t.Fatal(err)
+	}
+	keyring := mig.Keyring{"op1": mig.KeyringEntry{PublicKey: pub}}
+	if _, err := m.Verify(keyring); err != nil {
+		t.Fatalf("expected a valid signature to verify, got %v", err)
+	}
+}
+
+func TestVerifyRejectsTamperedPayload(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := m.SignManifest("op1", priv); err != nil {
+		t.Fatal(err)
+	}
+	m.Entries[0].Blob.SHA256 = "tampered"
+
+	keyring := mig.Keyring{"op1": mig.KeyringEntry{PublicKey: pub}}
+	if _, err := m.Verify(keyring); err == nil {
+		t.Fatal("expected a tampered payload to fail verification")
+	}
+}
+
+// TestVerifyRejectsTamperedOperator covers the binding this manifest
+// format exists to provide: Operator is part of the signed payload, so a
+// manifest re-labeled for a different operator after signing (e.g. by an
+// API serving up a digest that doesn't match what it claims to) no
+// longer verifies, even though its entries are untouched.
+func TestVerifyRejectsTamperedOperator(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := m.SignManifest("op1", priv); err != nil {
+		t.Fatal(err)
+	}
+	m.Operator = "op2"
+
+	keyring := mig.Keyring{"op1": mig.KeyringEntry{PublicKey: pub}}
+	if _, err := m.Verify(keyring); err == nil {
+		t.Fatal("expected a manifest re-labeled for a different operator to fail verification")
+	}
+}
+
+// TestVerifyRejectsTamperedPlatform is the platform counterpart to
+// TestVerifyRejectsTamperedOperator: Platform is signed too, so a
+// manifest can't be replayed as if it were issued for a different
+// OS/arch/variant than it actually was.
+func TestVerifyRejectsTamperedPlatform(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := m.SignManifest("op1", priv); err != nil {
+		t.Fatal(err)
+	}
+	m.Platform.Arch = "arm64"
+
+	keyring := mig.Keyring{"op1": mig.KeyringEntry{PublicKey: pub}}
+	if _, err := m.Verify(keyring); err == nil {
+		t.Fatal("expected a manifest re-labeled for a different platform to fail verification")
+	}
+}
+
+func TestVerifyRejectsWrongKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrustedPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := m.SignManifest("op1", priv); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := mig.Keyring{"op1": mig.KeyringEntry{PublicKey: untrustedPub}}
+	if _, err := m.Verify(keyring); err == nil {
+		t.Fatal("expected a signature from an untrusted key to fail verification")
+	}
+}
+
+func TestVerifyRejectsExpiredKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testManifest()
+	if err := m.SignManifest("op1", priv); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := mig.Keyring{"op1": mig.KeyringEntry{PublicKey: pub, Expires: time.Now().Add(-time.Hour)}}
+	if _, err := m.Verify(keyring); err == nil {
+		t.Fatal("expected a signature from an expired key to fail verification")
+	}
+}
+
+func TestVerifyRejectsNoSignatures(t *testing.T) {
+	m := testManifest()
+	if _, err := m.Verify(mig.Keyring{}); err == nil {
+		t.Fatal("expected a manifest with no signatures to fail verification")
+	}
+}